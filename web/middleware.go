@@ -15,9 +15,16 @@
 package web
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
-	"encoding/hex"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net"
+	"net/url"
 	"os"
+	"regexp"
+	"strings"
 )
 
 type filterResponder struct {
@@ -50,59 +57,416 @@ const (
 	XSRFParamName  = "xsrf"
 )
 
-// ProxyHeaderHandler returns a handler that overrides the Request.RemoteAddr field
-// with the value of the header specified by addrName and the
+// SafeMethods is the set of request methods that are exempt from XSRF and
+// same-origin checks. Applications that add custom methods or otherwise
+// change what is considered "safe" can override this variable.
+var SafeMethods = map[string]bool{
+	"GET":     true,
+	"HEAD":    true,
+	"OPTIONS": true,
+	"TRACE":   true,
+}
+
+// Errors returned through Request.Error by the same-origin check performed
+// on https requests by FormHandler.
+var (
+	ErrNoReferer  = os.NewError("twister: missing Referer/Origin header")
+	ErrBadReferer = os.NewError("twister: Referer/Origin header does not match request URL")
+)
+
+// XSRFKey is the HMAC key used by FormHandler to authenticate the xsrf
+// cookie. Applications that run more than one process, or that want the
+// cookie to survive a restart, should set this to a persistent secret
+// value before serving requests. By default it holds a random key generated
+// when the process starts.
+var XSRFKey = randomKey(32)
+
+func randomKey(n int) []byte {
+	p := make([]byte, n)
+	if _, err := rand.Reader.Read(p); err != nil {
+		panic("twister: rand read failed")
+	}
+	return p
+}
+
+// SecureCookie returns a cookie named name whose value is the base64
+// encoding of value authenticated with an HMAC computed using key. Use
+// DecodeSecureCookie to recover and verify value from the cookie sent by
+// the client on a later request.
+func SecureCookie(name string, value []byte, key []byte) *Cookie {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(value)
+	encoded := base64.URLEncoding.EncodeToString(value) + "." + base64.URLEncoding.EncodeToString(mac.Sum(nil))
+	return NewCookie(name, encoded)
+}
+
+// DecodeSecureCookie recovers the value encoded in s by SecureCookie,
+// returning ok == false if s is malformed or the HMAC computed using key
+// does not match.
+func DecodeSecureCookie(s string, key []byte) (value []byte, ok bool) {
+	i := strings.Index(s, ".")
+	if i < 0 {
+		return nil, false
+	}
+	value, err := base64.URLEncoding.DecodeString(s[:i])
+	if err != nil {
+		return nil, false
+	}
+	sig, err := base64.URLEncoding.DecodeString(s[i+1:])
+	if err != nil {
+		return nil, false
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(value)
+	if subtle.ConstantTimeCompare(sig, mac.Sum(nil)) != 1 {
+		return nil, false
+	}
+	return value, true
+}
+
+// xsrfEnvKey is the Request.Env key under which the masked xsrf token
+// generated for the current response is stored for retrieval by
+// Request.XSRFToken.
+const xsrfEnvKey = "twister.xsrf-token"
+
+// XSRFToken returns the one-time masked xsrf token generated by FormHandler
+// for this response. Use it to fill in a hidden form field or to hand the
+// value to AJAX code for the X-XSRFToken header. A fresh mask is computed
+// for every response, so the value changes from page to page even though it
+// authenticates against the same cookie; this keeps the token from being
+// recovered from a TLS-compressed response by a BREACH-style attack.
+func (req *Request) XSRFToken() string {
+	s, _ := req.Env[xsrfEnvKey].(string)
+	return s
+}
+
+// maskXSRFToken XORs token with a freshly generated one-time pad p and
+// returns the base64 encoding of p concatenated with the masked token.
+func maskXSRFToken(token []byte) string {
+	masked := make([]byte, 2*len(token))
+	p := masked[:len(token)]
+	if _, err := rand.Reader.Read(p); err != nil {
+		panic("twister: rand read failed")
+	}
+	for i, b := range token {
+		masked[len(token)+i] = p[i] ^ b
+	}
+	return base64.URLEncoding.EncodeToString(masked)
+}
+
+// unmaskXSRFToken reverses maskXSRFToken, returning ok == false if s is not
+// a validly formed masked token.
+func unmaskXSRFToken(s string) (token []byte, ok bool) {
+	masked, err := base64.URLEncoding.DecodeString(s)
+	if err != nil || len(masked) == 0 || len(masked)%2 != 0 {
+		return nil, false
+	}
+	n := len(masked) / 2
+	p, enc := masked[:n], masked[n:]
+	token = make([]byte, n)
+	for i := range token {
+		token[i] = p[i] ^ enc[i]
+	}
+	return token, true
+}
+
+// checkOrigin verifies that the Referer (falling back to Origin) header of
+// an unsafe request made over https has a scheme and host matching the
+// request URL. This defends against network attackers who can plant a xsrf
+// cookie (e.g. over http on a shared network) but cannot spoof the Referer
+// sent by the browser from a cross-origin page.
+func checkOrigin(req *Request) os.Error {
+	if req.URL.Scheme != "https" || SafeMethods[req.Method] {
+		return nil
+	}
+	referer := req.Header.Get(HeaderReferer)
+	if referer == "" {
+		referer = req.Header.Get(HeaderOrigin)
+	}
+	if referer == "" {
+		return ErrNoReferer
+	}
+	u, err := url.Parse(referer)
+	if err != nil || u.Scheme != req.URL.Scheme || u.Host != req.URL.Host {
+		return ErrBadReferer
+	}
+	return nil
+}
+
+// ForwardedForHeader is the legacy header used to relay the chain of
+// addresses a request has passed through on its way to the server.
+const ForwardedForHeader = "X-Forwarded-For"
+
+// ProxyConfig configures the header-based fix up performed by ProxyHandler.
+// The zero value trusts every connection: it reads AddrHeader and
+// SchemeHeader exactly as the original ProxyHeaderHandler did, and does not
+// look at X-Forwarded-For or a Forwarded header.
+type ProxyConfig struct {
+	// AddrHeader and SchemeHeader name the headers that override
+	// Request.RemoteAddr and Request.URL.Scheme. The header names must be
+	// in canonical header name format. No fix up is done for a field if
+	// its header name is "" or the header is not present. AddrHeader is
+	// ignored in favor of the Forwarded or X-Forwarded-For header when
+	// ForwardedHeader or ForwardedForHeader is set and present on the
+	// request.
+	AddrHeader   string
+	SchemeHeader string
+
+	// ForwardedHeader is the name of the RFC 7239 header to parse with
+	// ParseForwarded, e.g. "Forwarded". When this header is present, its
+	// for, proto, and host parameters take precedence over
+	// ForwardedForHeader and AddrHeader/SchemeHeader. The zero value
+	// disables RFC 7239 support.
+	ForwardedHeader string
+
+	// ForwardedForHeader is the name of the header to parse as a
+	// comma-separated X-Forwarded-For chain, e.g. the package constant
+	// ForwardedForHeader. When this header is present, it takes
+	// precedence over AddrHeader. The zero value disables X-Forwarded-For
+	// chain support, so that setting only AddrHeader and SchemeHeader
+	// behaves exactly as it did before chain support was added.
+	ForwardedForHeader string
+
+	// TrustedProxies lists the networks a direct connection must come
+	// from for any of the headers above to be honored at all. This stops
+	// a client from spoofing its own address by connecting directly to
+	// the application and setting, say, X-Real-Ip itself. The zero value
+	// trusts every connection, matching ProxyHeaderHandler's historical
+	// behavior; production deployments behind a known proxy should set
+	// this.
+	TrustedProxies []*net.IPNet
+}
+
+func (cfg ProxyConfig) trustedAddr(addr string) bool {
+	if len(cfg.TrustedProxies) == 0 {
+		return true
+	}
+	ip := proxyIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range cfg.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveClient walks hops, the X-Forwarded-For or Forwarded for= chain as
+// written (oldest hop first), from the newest end backward, returning the
+// address and index of the first hop that is not itself a trusted proxy.
+// If every hop is trusted, the oldest hop is returned.
+func (cfg ProxyConfig) resolveClient(hops []string) (addr string, index int, ok bool) {
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		addr, index, ok = hop, i, true
+		if !cfg.trustedAddr(hop) {
+			return addr, index, ok
+		}
+	}
+	return addr, index, ok
+}
+
+// proxyIP extracts the IP address from s, which may be a bare address, a
+// host:port pair, or a bracketed IPv6 address with or without a port.
+func proxyIP(s string) net.IP {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	} else {
+		s = strings.Trim(s, "[]")
+	}
+	return net.ParseIP(s)
+}
+
+// ForwardedElement holds the parameters of one hop of an RFC 7239 Forwarded
+// header.
+type ForwardedElement struct {
+	For   string
+	Proto string
+	Host  string
+}
+
+// ParseForwarded parses the value of an RFC 7239 Forwarded header into one
+// ForwardedElement per comma-separated hop, in the order the hops appear in
+// the header (oldest hop first, as with ForwardedForHeader). Parameters
+// other than for, proto, and host are ignored; an element with none of
+// those three parameters is omitted from the result.
+func ParseForwarded(header string) []ForwardedElement {
+	var elems []ForwardedElement
+	for _, part := range splitUnquoted(header, ',') {
+		var e ForwardedElement
+		for _, pair := range splitUnquoted(part, ';') {
+			kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			v := strings.Trim(strings.TrimSpace(kv[1]), `"`)
+			switch strings.ToLower(strings.TrimSpace(kv[0])) {
+			case "for":
+				e.For = v
+			case "proto":
+				e.Proto = v
+			case "host":
+				e.Host = v
+			}
+		}
+		if e.For != "" || e.Proto != "" || e.Host != "" {
+			elems = append(elems, e)
+		}
+	}
+	return elems
+}
+
+// splitUnquoted splits s on occurrences of sep that are not inside a
+// double-quoted substring.
+func splitUnquoted(s string, sep byte) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case sep:
+			if !quoted {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// ProxyHandler returns a handler that overrides Request.RemoteAddr and
+// Request.URL.Scheme (and, from a Forwarded header, Request.URL.Host) with
+// values supplied by a reverse proxy, as configured by cfg.
+//
+// The headers are only honored for a request whose direct peer address
+// (Request.RemoteAddr as set by the listener) is inside one of
+// cfg.TrustedProxies, or for every request when cfg.TrustedProxies is empty;
+// otherwise the request is passed through unchanged.
+// This matters because any of these headers can otherwise be set directly
+// by the client, spoofing its own address or scheme to defeat IP-based
+// rate limiting or an https-only check.
+//
+// When cfg.ForwardedHeader is set and present on the request, it is parsed
+// with ParseForwarded and takes precedence over cfg.ForwardedForHeader and
+// cfg.AddrHeader/SchemeHeader. Otherwise, when cfg.ForwardedForHeader is set
+// and present, it is used instead of cfg.AddrHeader. Both
+// cfg.ForwardedHeader and cfg.ForwardedForHeader default to "", so an
+// existing ProxyHeaderHandler caller that only configures AddrHeader and
+// SchemeHeader keeps reading exactly those headers. In both cases the chain
+// of addresses is walked from the newest hop backward, stopping at the
+// first hop that is not itself inside cfg.TrustedProxies; see
+// resolveClient. This makes it safe to sit behind a chain of proxies, some
+// trusted and some not, as can happen when a request has passed through
+// more than one hop before reaching a trusted
+// proxy.
+//
+// Here's an example of how to use this handler with Nginx. In the nginx
+// proxy configuration, specify a header for the IP address and scheme. The
+// host header should also be passed through the proxy:
+//
+//	location / {
+//	    proxy_set_header X-Real-IP $remote_addr;
+//	    proxy_set_header X-Scheme $scheme;
+//	    proxy_set_header Host $http_host;
+//	    proxy_pass http://127.0.0.1:8080;
+//	}
+//
+// In the main function for the application, wrap the application handler
+// with the proxy fix up:
+//
+//	 import (
+//	     "net"
+//	     "github.com/garyburd/twister/web"
+//	     "github.com/garyburd/twister/server"
+//	 )
+//
+//	 func main() {
+//	     var h web.Handler
+//	     ... setup the application handler
+//	     _, loopback, _ := net.ParseCIDR("127.0.0.1/32")
+//	     h = web.ProxyHandler(web.ProxyConfig{
+//	         AddrHeader:     "X-Real-Ip",
+//	         SchemeHeader:   "X-Scheme",
+//	         TrustedProxies: []*net.IPNet{loopback},
+//	     }, h)
+//		    server.Run(":8080", h)
+//	 }
+func ProxyHandler(cfg ProxyConfig, h Handler) Handler {
+	return proxyHandler{cfg: cfg, h: h}
+}
+
+// ProxyHeaderHandler returns a handler that overrides the Request.RemoteAddr
+// field with the value of the header specified by addrName and the
 // Request.URL.Scheme field with the value of the header specified by
-// schemeName. No fix up is done for a field if the header name equals "" or the
-// header is not present.
-//
-// The header names must be in canonical header name format.
-// 
-// Here's an example of how to use this handler with Nginx. In the nginx proxy
-// configuration, specify a header for the IP address and scheme. The host
-// header should also be passed through the proxy:
-//
-//    location / {
-//        proxy_set_header X-Real-IP $remote_addr;
-//        proxy_set_header X-Scheme $scheme;
-//        proxy_set_header Host $http_host;
-//        proxy_pass http://127.0.0.1:8080;
-//    }       
-//
-// In the main function for the application, wrap the application handler with
-// the proxy fix up:
-//  
-//  import (
-//      "github.com/garyburd/twister/web"
-//      "github.com/garyburd/twister/server"
-//  )
-//
-//  func main() {
-//      var h web.Handler
-//      ... setup the application handler
-//      h = web.ProxyHeaderHandler("X-Scheme", "X-Real-Ip", h)
-//	    server.Run(":8080", h)
-//  }
+// schemeName. No fix up is done for a field if the header name equals "" or
+// the header is not present.
+//
+// ProxyHeaderHandler trusts these headers unconditionally, so it must only
+// be used behind a proxy that strips them from incoming requests before
+// setting its own. Applications that want X-Forwarded-For or Forwarded
+// header support, or that want the headers honored only from a known set
+// of proxy addresses, should call ProxyHandler directly instead.
 func ProxyHeaderHandler(addrName, schemeName string, h Handler) Handler {
-	return proxyHeaderHandler{
-		addrName:   addrName,
-		schemeName: schemeName,
-		h:          h,
-	}
+	return ProxyHandler(ProxyConfig{AddrHeader: addrName, SchemeHeader: schemeName}, h)
 }
 
-type proxyHeaderHandler struct {
-	addrName, schemeName string
-	h                    Handler
+type proxyHandler struct {
+	cfg ProxyConfig
+	h   Handler
 }
 
-func (h proxyHeaderHandler) ServeWeb(req *Request) {
-	if s := req.Header.Get(h.addrName); s != "" {
-		req.RemoteAddr = s
+func (h proxyHandler) ServeWeb(req *Request) {
+	if !h.cfg.trustedAddr(req.RemoteAddr) {
+		h.h.ServeWeb(req)
+		return
 	}
-	if s := req.Header.Get(h.schemeName); s != "" {
-		req.URL.Scheme = s
+
+	switch {
+	case h.cfg.ForwardedHeader != "" && req.Header.Get(h.cfg.ForwardedHeader) != "":
+		elems := ParseForwarded(req.Header.Get(h.cfg.ForwardedHeader))
+		fors := make([]string, len(elems))
+		for i, e := range elems {
+			fors[i] = e.For
+		}
+		if addr, index, ok := h.cfg.resolveClient(fors); ok {
+			req.RemoteAddr = addr
+			if elems[index].Proto != "" {
+				req.URL.Scheme = elems[index].Proto
+			}
+			if elems[index].Host != "" {
+				req.URL.Host = elems[index].Host
+			}
+		}
+	case h.cfg.ForwardedForHeader != "" && req.Header.Get(h.cfg.ForwardedForHeader) != "":
+		hops := strings.Split(req.Header.Get(h.cfg.ForwardedForHeader), ",")
+		if addr, _, ok := h.cfg.resolveClient(hops); ok {
+			req.RemoteAddr = addr
+		}
+		if h.cfg.SchemeHeader != "" {
+			if s := req.Header.Get(h.cfg.SchemeHeader); s != "" {
+				req.URL.Scheme = s
+			}
+		}
+	default:
+		if h.cfg.AddrHeader != "" {
+			if s := req.Header.Get(h.cfg.AddrHeader); s != "" {
+				req.RemoteAddr = s
+			}
+		}
+		if h.cfg.SchemeHeader != "" {
+			if s := req.Header.Get(h.cfg.SchemeHeader); s != "" {
+				req.URL.Scheme = s
+			}
+		}
 	}
+
 	h.h.ServeWeb(req)
 }
 
@@ -116,30 +480,23 @@ func ProcessForm(maxRequestBodyLen int, checkXSRF bool, handler Handler) Handler
 // If the request body is larger than maxRequestBodyLen, then the handler
 // responds with an error instead of parsing the request body.
 //
-// If xsrfCheck is true, then cross-site request forgery protection is enabled.
-// The handler rejects POST, PUT, and DELETE requests if the handler does not
-// find a matching value for the "xsrf" cookie in the "xsrf" request parameter
-// or the X-XSRFToken header. 
-//
-// The handler ensures that the "xsrf" cookie and the "xsrf" request parameter
-// are set before passing the the request to the downstream handler or the
-// error handler. The application must include the value fo the "xsrf" request
-// parameter in POSTed forms or pass the value to AJAX code so that the
-// X-XSRFToken header can be set.
-//
-// See http://en.wikipedia.org/wiki/Cross-site_request_forgery for information
-// on cross-site request forgery.
+// If checkXSRF is true, then the returned handler also wraps h with
+// XSRFHandler using the zero value of XSRFConfig. Applications that need to
+// customize the xsrf check (cookie attributes, exempt paths, a failure
+// handler, and so on) should call XSRFHandler directly instead of setting
+// checkXSRF.
 func FormHandler(maxRequestBodyLen int, checkXSRF bool, h Handler) Handler {
+	if checkXSRF {
+		h = XSRFHandler(XSRFConfig{}, h)
+	}
 	return formHandler{
 		maxRequestBodyLen: maxRequestBodyLen,
-		checkXSRF:         checkXSRF,
 		h:                 h,
 	}
 }
 
 type formHandler struct {
 	maxRequestBodyLen int
-	checkXSRF         bool
 	h                 Handler
 }
 
@@ -155,43 +512,294 @@ func (h formHandler) ServeWeb(req *Request) {
 		req.Error(status, os.NewError("twister: Error reading or parsing form."))
 		return
 	}
+	h.h.ServeWeb(req)
+}
 
-	if h.checkXSRF {
-		const tokenLen = 8
-		expectedToken := req.Cookie.Get(XSRFCookieName)
+// XSRFConfig configures the cross-site request forgery protection applied
+// by XSRFHandler. The zero value is a usable default: a "xsrf" cookie and
+// parameter, the submitted token looked up first from the X-XSRFToken
+// header and then the "xsrf" parameter, a 32-byte token, and no exemptions.
+//
+// XSRFHandler must run downstream of a handler that has already called
+// Request.ParseForm, such as FormHandler, since it reads the submitted
+// token through Request.Param.
+type XSRFConfig struct {
+	// CookieName is the name of the cookie used to store the xsrf token.
+	// The zero value is XSRFCookieName.
+	CookieName string
 
-		// Create new XSRF token?
-		if len(expectedToken) != tokenLen {
-			p := make([]byte, tokenLen/2)
-			_, err := rand.Reader.Read(p)
-			if err != nil {
-				panic("twister: rand read failed")
-			}
-			expectedToken = hex.EncodeToString(p)
-			c := NewCookie(XSRFCookieName, expectedToken).String()
-			FilterRespond(req, func(status int, header HeaderMap) (int, HeaderMap) {
-				header.Add(HeaderSetCookie, c)
-				return status, header
-			})
-		}
-
-		actualToken := req.Param.Get(XSRFParamName)
-		if actualToken == "" {
-			actualToken = req.Header.Get(HeaderXXSRFToken)
-			req.Param.Set(XSRFParamName, expectedToken)
-		}
-		if expectedToken != actualToken {
-			req.Param.Set(XSRFParamName, expectedToken)
-			if req.Method == "POST" ||
-				req.Method == "PUT" ||
-				req.Method == "DELETE" {
-				err := os.NewError("twister: bad xsrf token")
-				if actualToken == "" {
-					err = os.NewError("twister: missing xsrf token")
-				}
-				req.Error(StatusNotFound, err)
-				return
+	// CookiePath, CookieDomain, and CookieMaxAge, if set, are applied to
+	// the xsrf cookie. CookieMaxAge of 0 makes the cookie a session cookie.
+	CookiePath   string
+	CookieDomain string
+	CookieMaxAge int
+
+	// Secure and HttpOnly are applied to the xsrf cookie. Applications
+	// serving over https should set Secure to true.
+	Secure   bool
+	HttpOnly bool
+
+	// SameSite, if not empty, is applied to the xsrf cookie, e.g. "Lax" or
+	// "Strict".
+	SameSite string
+
+	// HeaderName and ParamName are the header and request parameter that
+	// the zero value of TokenLookup is built from. The zero values are
+	// "X-XSRFToken" and XSRFParamName.
+	HeaderName string
+	ParamName  string
+
+	// TokenLength is the length, in bytes, of the xsrf token. The zero
+	// value is 32.
+	TokenLength int
+
+	// TokenLookup is a comma separated list of sources to search, in
+	// order, for the submitted token. Each source is "header:<name>" or
+	// "param:<name>", where "param" covers both query string and form
+	// body values since Request.Param does not distinguish between them.
+	// The zero value is built from HeaderName and ParamName.
+	TokenLookup string
+
+	// Key is the HMAC key used to authenticate the xsrf cookie. The zero
+	// value is XSRFKey.
+	Key []byte
+
+	// ExemptPaths, ExemptPathPrefixes, and ExemptPathRegexps exempt
+	// matching request paths from the xsrf check entirely: no cookie is
+	// set and no token is required. Use these for webhook and API
+	// endpoints that authenticate by other means.
+	ExemptPaths        []string
+	ExemptPathPrefixes []string
+	ExemptPathRegexps  []*regexp.Regexp
+
+	// Skipper, if not nil, is called for every request; the xsrf check is
+	// skipped entirely for requests where it returns true.
+	Skipper func(req *Request) bool
+
+	// FailureHandler, if not nil, is called instead of Request.Error when
+	// the xsrf check fails. Request.XSRFFailureReason reports why the
+	// check failed, e.g. to let the handler render a JSON body for an API
+	// or log the reason before responding.
+	FailureHandler Handler
+
+	// FailureStatus is the status passed to Request.Error when the xsrf
+	// check fails and FailureHandler is nil. The zero value is
+	// StatusForbidden.
+	FailureStatus int
+}
+
+// XSRFReason identifies why the xsrf check performed by XSRFHandler failed,
+// as reported by Request.XSRFFailureReason.
+type XSRFReason int
+
+const (
+	// ReasonNoToken means the request did not include a token through any
+	// of the sources named by XSRFConfig.TokenLookup.
+	ReasonNoToken XSRFReason = iota + 1
+
+	// ReasonBadToken means the submitted token did not match the xsrf
+	// cookie.
+	ReasonBadToken
+
+	// ReasonBadReferer means the request was missing a Referer/Origin
+	// header, or the header did not match the request URL. See
+	// checkOrigin.
+	ReasonBadReferer
+)
+
+// xsrfReasonEnvKey is the Request.Env key under which the XSRFReason for a
+// failed check is stored for retrieval by Request.XSRFFailureReason.
+const xsrfReasonEnvKey = "twister.xsrf-reason"
+
+// XSRFFailureReason returns the reason the xsrf check performed by
+// XSRFHandler failed for this request. It is only meaningful from within a
+// XSRFConfig.FailureHandler.
+func (req *Request) XSRFFailureReason() XSRFReason {
+	reason, _ := req.Env[xsrfReasonEnvKey].(XSRFReason)
+	return reason
+}
+
+// tokenSource identifies one place XSRFHandler looks for a submitted xsrf
+// token, as parsed from XSRFConfig.TokenLookup.
+type tokenSource struct {
+	kind string // "header" or "param"
+	name string
+}
+
+func parseTokenLookup(lookup string) []tokenSource {
+	var sources []tokenSource
+	for _, part := range strings.Split(lookup, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), ":", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			continue
+		}
+		sources = append(sources, tokenSource{kv[0], kv[1]})
+	}
+	return sources
+}
+
+// XSRFHandler returns a handler that implements cross-site request forgery
+// protection as configured by cfg.
+//
+// The handler rejects requests whose method is not in SafeMethods if it
+// does not find a matching value for the xsrf cookie among the sources
+// named by cfg.TokenLookup. For requests received over https, the handler
+// additionally requires that the Referer header (or, if absent, the Origin
+// header) have a scheme and host matching the request URL; see checkOrigin.
+//
+// The xsrf cookie holds a token authenticated with an HMAC keyed by
+// cfg.Key, so that the token cannot be forged by an attacker who can only
+// set cookies. The value exposed through the request parameter named by
+// cfg.ParamName and through Request.XSRFToken is not the token itself but a
+// one-time masked version of it, newly generated for every response, so
+// that the token cannot be recovered from a TLS-compressed page by a
+// BREACH-style attack. The application must include the value of
+// Request.XSRFToken in POSTed forms or pass it to AJAX code so that it can
+// be submitted through one of the sources named by cfg.TokenLookup.
+//
+// On failure, the handler calls Request.Error with cfg.FailureStatus
+// (StatusForbidden by default), or invokes cfg.FailureHandler instead if it
+// is set. Request.XSRFFailureReason reports the reason for the failure.
+//
+// See http://en.wikipedia.org/wiki/Cross-site_request_forgery for
+// information on cross-site request forgery.
+func XSRFHandler(cfg XSRFConfig, h Handler) Handler {
+	if cfg.CookieName == "" {
+		cfg.CookieName = XSRFCookieName
+	}
+	if cfg.ParamName == "" {
+		cfg.ParamName = XSRFParamName
+	}
+	if cfg.HeaderName == "" {
+		cfg.HeaderName = "X-XSRFToken"
+	}
+	if cfg.TokenLength == 0 {
+		cfg.TokenLength = 32
+	}
+	if cfg.TokenLookup == "" {
+		cfg.TokenLookup = "header:" + cfg.HeaderName + ",param:" + cfg.ParamName
+	}
+	if cfg.Key == nil {
+		cfg.Key = XSRFKey
+	}
+	return xsrfHandler{
+		cfg:     cfg,
+		sources: parseTokenLookup(cfg.TokenLookup),
+		h:       h,
+	}
+}
+
+type xsrfHandler struct {
+	cfg     XSRFConfig
+	sources []tokenSource
+	h       Handler
+}
+
+// fail records reason in req.Env and responds to the request, either
+// through cfg.FailureHandler or, if that is nil, through Request.Error with
+// cfg.FailureStatus.
+func (h xsrfHandler) fail(req *Request, reason XSRFReason, err os.Error) {
+	req.Env[xsrfReasonEnvKey] = reason
+	if h.cfg.FailureHandler != nil {
+		h.cfg.FailureHandler.ServeWeb(req)
+		return
+	}
+	status := h.cfg.FailureStatus
+	if status == 0 {
+		status = StatusForbidden
+	}
+	req.Error(status, err)
+}
+
+func (h xsrfHandler) exempt(req *Request) bool {
+	if h.cfg.Skipper != nil && h.cfg.Skipper(req) {
+		return true
+	}
+	path := req.URL.Path
+	for _, p := range h.cfg.ExemptPaths {
+		if p == path {
+			return true
+		}
+	}
+	for _, prefix := range h.cfg.ExemptPathPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	for _, re := range h.cfg.ExemptPathRegexps {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h xsrfHandler) lookupToken(req *Request) string {
+	for _, src := range h.sources {
+		var v string
+		switch src.kind {
+		case "header":
+			v = req.Header.Get(src.name)
+		case "param":
+			v = req.Param.Get(src.name)
+		}
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func (h xsrfHandler) ServeWeb(req *Request) {
+	if h.exempt(req) {
+		h.h.ServeWeb(req)
+		return
+	}
+
+	expectedToken, ok := DecodeSecureCookie(req.Cookie.Get(h.cfg.CookieName), h.cfg.Key)
+
+	// Create new XSRF token?
+	if !ok || len(expectedToken) != h.cfg.TokenLength {
+		expectedToken = randomKey(h.cfg.TokenLength)
+		c := SecureCookie(h.cfg.CookieName, expectedToken, h.cfg.Key)
+		c.Path = h.cfg.CookiePath
+		c.Domain = h.cfg.CookieDomain
+		c.MaxAge = h.cfg.CookieMaxAge
+		c.Secure = h.cfg.Secure
+		c.HttpOnly = h.cfg.HttpOnly
+		c.SameSite = h.cfg.SameSite
+		cs := c.String()
+		FilterRespond(req, func(status int, header HeaderMap) (int, HeaderMap) {
+			header.Add(HeaderSetCookie, cs)
+			return status, header
+		})
+	}
+
+	var actualMasked string
+	if !SafeMethods[req.Method] {
+		actualMasked = h.lookupToken(req)
+	}
+
+	maskedToken := maskXSRFToken(expectedToken)
+	req.Env[xsrfEnvKey] = maskedToken
+	req.Param.Set(h.cfg.ParamName, maskedToken)
+
+	if !SafeMethods[req.Method] {
+		actualToken, unmaskOk := unmaskXSRFToken(actualMasked)
+		if !unmaskOk || subtle.ConstantTimeCompare(actualToken, expectedToken) != 1 {
+			reason := ReasonBadToken
+			err := os.NewError("twister: bad xsrf token")
+			if actualMasked == "" {
+				reason = ReasonNoToken
+				err = os.NewError("twister: missing xsrf token")
 			}
+			h.fail(req, reason, err)
+			return
+		}
+
+		if err := checkOrigin(req); err != nil {
+			h.fail(req, ReasonBadReferer, err)
+			return
 		}
 	}
 
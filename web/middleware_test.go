@@ -0,0 +1,306 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"net"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func mustCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func TestParseForwarded(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   []ForwardedElement
+	}{
+		{
+			name:   "single hop",
+			header: `for=192.0.2.60;proto=http;by=203.0.113.43`,
+			want:   []ForwardedElement{{For: "192.0.2.60", Proto: "http"}},
+		},
+		{
+			name:   "quoted ipv6 for with port",
+			header: `for="[2001:db8:cafe::17]:4711"`,
+			want:   []ForwardedElement{{For: "[2001:db8:cafe::17]:4711"}},
+		},
+		{
+			name:   "multiple hops",
+			header: `for=192.0.2.60, for=198.51.100.17;proto=https;host=example.com`,
+			want: []ForwardedElement{
+				{For: "192.0.2.60"},
+				{For: "198.51.100.17", Proto: "https", Host: "example.com"},
+			},
+		},
+		{
+			name:   "obfuscated and unknown identifiers",
+			header: `for=_hidden, for=unknown`,
+			want: []ForwardedElement{
+				{For: "_hidden"},
+				{For: "unknown"},
+			},
+		},
+		{
+			name:   "unrecognized parameter ignored",
+			header: `by=203.0.113.43;for=192.0.2.60`,
+			want:   []ForwardedElement{{For: "192.0.2.60"}},
+		},
+		{
+			name:   "element with only unrecognized parameters is dropped",
+			header: `by=203.0.113.43`,
+			want:   nil,
+		},
+		{
+			name:   "parameter names are case insensitive",
+			header: `For=192.0.2.60;Proto=HTTPS`,
+			want:   []ForwardedElement{{For: "192.0.2.60", Proto: "HTTPS"}},
+		},
+		{
+			name:   "empty header",
+			header: "",
+			want:   nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ParseForwarded(tt.header)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseForwarded(%q) = %#v, want %#v", tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitUnquoted(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		sep  byte
+		want []string
+	}{
+		{"no separator", "abc", ',', []string{"abc"}},
+		{"simple split", "a,b,c", ',', []string{"a", "b", "c"}},
+		{"separator inside quotes is ignored", `a,"b,c",d`, ',', []string{"a", `"b,c"`, "d"}},
+		{"empty string", "", ',', []string{""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitUnquoted(tt.s, tt.sep)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitUnquoted(%q, %q) = %#v, want %#v", tt.s, tt.sep, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyIP(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		want string // "" means proxyIP is expected to return nil
+	}{
+		{"bare ipv4", "203.0.113.5", "203.0.113.5"},
+		{"ipv4 with port", "203.0.113.5:1234", "203.0.113.5"},
+		{"bracketed ipv6 without port", "[2001:db8::1]", "2001:db8::1"},
+		{"bracketed ipv6 with port", "[2001:db8::1]:8080", "2001:db8::1"},
+		{"garbage", "not-an-ip", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip := proxyIP(tt.s)
+			if tt.want == "" {
+				if ip != nil {
+					t.Errorf("proxyIP(%q) = %v, want nil", tt.s, ip)
+				}
+				return
+			}
+			if ip == nil || ip.String() != tt.want {
+				t.Errorf("proxyIP(%q) = %v, want %s", tt.s, ip, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyConfigResolveClient(t *testing.T) {
+	trusted := ProxyConfig{TrustedProxies: []*net.IPNet{mustCIDR("10.0.0.0/8")}}
+
+	tests := []struct {
+		name      string
+		cfg       ProxyConfig
+		hops      []string
+		wantAddr  string
+		wantIndex int
+		wantOK    bool
+	}{
+		{
+			name:      "every hop trusted falls back to the oldest hop",
+			cfg:       trusted,
+			hops:      []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+			wantAddr:  "10.0.0.1",
+			wantIndex: 0,
+			wantOK:    true,
+		},
+		{
+			name:      "stops at the first untrusted hop from the right",
+			cfg:       trusted,
+			hops:      []string{"203.0.113.5", "10.0.0.2", "10.0.0.3"},
+			wantAddr:  "203.0.113.5",
+			wantIndex: 0,
+			wantOK:    true,
+		},
+		{
+			name:      "untrusted hop behind a trusted proxy is the client",
+			cfg:       trusted,
+			hops:      []string{"10.0.0.1", "203.0.113.5", "10.0.0.3"},
+			wantAddr:  "203.0.113.5",
+			wantIndex: 1,
+			wantOK:    true,
+		},
+		{
+			name:      "zero value TrustedProxies trusts every hop",
+			cfg:       ProxyConfig{},
+			hops:      []string{"203.0.113.5", "198.51.100.9"},
+			wantAddr:  "203.0.113.5",
+			wantIndex: 0,
+			wantOK:    true,
+		},
+		{
+			name:   "no hops",
+			cfg:    trusted,
+			hops:   nil,
+			wantOK: false,
+		},
+		{
+			name:      "blank entries are skipped",
+			cfg:       trusted,
+			hops:      []string{"10.0.0.1", "", " "},
+			wantAddr:  "10.0.0.1",
+			wantIndex: 0,
+			wantOK:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, index, ok := tt.cfg.resolveClient(tt.hops)
+			if ok != tt.wantOK {
+				t.Fatalf("resolveClient(%v) ok = %v, want %v", tt.hops, ok, tt.wantOK)
+			}
+			if ok && (addr != tt.wantAddr || index != tt.wantIndex) {
+				t.Errorf("resolveClient(%v) = (%q, %d), want (%q, %d)", tt.hops, addr, index, tt.wantAddr, tt.wantIndex)
+			}
+		})
+	}
+}
+
+func TestProxyHandlerServeWeb(t *testing.T) {
+	type got struct {
+		addr   string
+		scheme string
+		host   string
+	}
+
+	tests := []struct {
+		name   string
+		cfg    ProxyConfig
+		remote string
+		header HeaderMap
+		scheme string
+		host   string
+		want   got
+	}{
+		{
+			name:   "legacy AddrHeader/SchemeHeader behavior is unchanged",
+			cfg:    ProxyConfig{AddrHeader: "X-Real-Ip", SchemeHeader: "X-Scheme"},
+			remote: "198.51.100.1:4000",
+			header: HeaderMap{
+				"X-Real-Ip":       {"203.0.113.9"},
+				"X-Scheme":        {"https"},
+				"X-Forwarded-For": {"198.51.100.200"},
+			},
+			scheme: "http",
+			host:   "example.com",
+			want:   got{addr: "203.0.113.9", scheme: "https", host: "example.com"},
+		},
+		{
+			name:   "X-Forwarded-For is ignored unless ForwardedForHeader is set",
+			cfg:    ProxyConfig{AddrHeader: "X-Real-Ip"},
+			remote: "198.51.100.1:4000",
+			header: HeaderMap{"X-Forwarded-For": {"203.0.113.9"}},
+			scheme: "http",
+			host:   "example.com",
+			want:   got{addr: "198.51.100.1:4000", scheme: "http", host: "example.com"},
+		},
+		{
+			name:   "X-Forwarded-For is honored once opted in",
+			cfg:    ProxyConfig{ForwardedForHeader: ForwardedForHeader, SchemeHeader: "X-Scheme"},
+			remote: "198.51.100.1:4000",
+			header: HeaderMap{
+				"X-Forwarded-For": {"203.0.113.9, 10.0.0.5"},
+				"X-Scheme":        {"https"},
+			},
+			scheme: "http",
+			host:   "example.com",
+			want:   got{addr: "203.0.113.9", scheme: "https", host: "example.com"},
+		},
+		{
+			name:   "Forwarded header takes precedence over X-Forwarded-For",
+			cfg:    ProxyConfig{ForwardedHeader: "Forwarded", ForwardedForHeader: ForwardedForHeader},
+			remote: "198.51.100.1:4000",
+			header: HeaderMap{
+				"Forwarded":       {`for=203.0.113.9;proto=https;host=real.example.com`},
+				"X-Forwarded-For": {"10.0.0.5"},
+			},
+			scheme: "http",
+			host:   "example.com",
+			want:   got{addr: "203.0.113.9", scheme: "https", host: "real.example.com"},
+		},
+		{
+			name:   "untrusted direct connection bypasses every header",
+			cfg:    ProxyConfig{AddrHeader: "X-Real-Ip", TrustedProxies: []*net.IPNet{mustCIDR("10.0.0.0/8")}},
+			remote: "198.51.100.1:4000",
+			header: HeaderMap{"X-Real-Ip": {"203.0.113.9"}},
+			scheme: "http",
+			host:   "example.com",
+			want:   got{addr: "198.51.100.1:4000", scheme: "http", host: "example.com"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &Request{
+				RemoteAddr: tt.remote,
+				Header:     tt.header,
+				URL:        &url.URL{Scheme: tt.scheme, Host: tt.host},
+			}
+			var g got
+			term := HandlerFunc(func(r *Request) {
+				g = got{addr: r.RemoteAddr, scheme: r.URL.Scheme, host: r.URL.Host}
+			})
+			ProxyHandler(tt.cfg, term).ServeWeb(req)
+			if g != tt.want {
+				t.Errorf("ServeWeb() = %+v, want %+v", g, tt.want)
+			}
+		})
+	}
+}
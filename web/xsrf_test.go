@@ -0,0 +1,85 @@
+// Copyright 2010 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestMaskUnmaskXSRFToken(t *testing.T) {
+	token := []byte("0123456789abcdef0123456789abcdef")
+
+	masked := maskXSRFToken(token)
+	got, ok := unmaskXSRFToken(masked)
+	if !ok {
+		t.Fatalf("unmaskXSRFToken(%q) ok = false, want true", masked)
+	}
+	if string(got) != string(token) {
+		t.Errorf("unmaskXSRFToken(maskXSRFToken(token)) = %x, want %x", got, token)
+	}
+
+	if masked2 := maskXSRFToken(token); masked2 == masked {
+		t.Error("maskXSRFToken produced the same masked value twice; the one-time pad must be fresh per call")
+	}
+
+	badTests := []struct {
+		name string
+		s    string
+	}{
+		{"not base64", "not valid base64!!"},
+		{"odd number of bytes after decoding", base64.URLEncoding.EncodeToString([]byte("odd"))},
+		{"empty", ""},
+	}
+	for _, tt := range badTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, ok := unmaskXSRFToken(tt.s); ok {
+				t.Errorf("unmaskXSRFToken(%q) ok = true, want false", tt.s)
+			}
+		})
+	}
+}
+
+func TestSecureCookieRoundTrip(t *testing.T) {
+	key := []byte("test-key-0123456789")
+	value := []byte("session-id-42")
+
+	c := SecureCookie("sess", value, key)
+	got, ok := DecodeSecureCookie(c.Value, key)
+	if !ok {
+		t.Fatalf("DecodeSecureCookie(%q) ok = false, want true", c.Value)
+	}
+	if string(got) != string(value) {
+		t.Errorf("DecodeSecureCookie round trip = %q, want %q", got, value)
+	}
+
+	if _, ok := DecodeSecureCookie(c.Value, []byte("wrong-key")); ok {
+		t.Error("DecodeSecureCookie with the wrong key ok = true, want false")
+	}
+
+	tampered := c.Value[:len(c.Value)-1] + "x"
+	if _, ok := DecodeSecureCookie(tampered, key); ok {
+		t.Error("DecodeSecureCookie of a tampered cookie ok = true, want false")
+	}
+
+	truncated := c.Value[:len(c.Value)/2]
+	if _, ok := DecodeSecureCookie(truncated, key); ok {
+		t.Error("DecodeSecureCookie of a truncated cookie ok = true, want false")
+	}
+
+	if _, ok := DecodeSecureCookie("no-separator", key); ok {
+		t.Error(`DecodeSecureCookie without a "." separator ok = true, want false`)
+	}
+}